@@ -6,7 +6,10 @@
 
 package runtime
 
-import "unsafe"
+import (
+	"runtime/internal/atomic"
+	"unsafe"
+)
 
 // tflag 再 reflect/type.go 中进行说明.
 //
@@ -119,9 +122,20 @@ func (t *_type) name() string {
 	}
 	s := t.string()
 	i := len(s) - 1
+	depth := 0
 	for i >= 0 {
-		if s[i] == '.' {
-			break
+		switch s[i] {
+		case ']':
+			depth++
+		case '[':
+			depth--
+		case '.':
+			// Only a '.' outside of a generic type's argument list
+			// separates the package path from the name; a dot inside
+			// e.g. "main.Map[main.K, main.V]" must not split the string.
+			if depth == 0 {
+				return s[i+1:]
+			}
 		}
 		i--
 	}
@@ -165,6 +179,14 @@ var reflectOffs struct {
 	next int32
 	m    map[int32]unsafe.Pointer
 	minv map[unsafe.Pointer]int32
+
+	// byHash holds, for every *_type handed out by canonicalizeReflectType,
+	// a bucket keyed by t.hash. It lets repeated reflect type builders
+	// (reflect.StructOf, MapOf, ...) that construct structurally identical
+	// types collapse onto the single *_type the first builder produced,
+	// preserving the pointer-equality invariant typelinksinit maintains
+	// for compile-time types.
+	byHash map[uint32][]*_type
 }
 
 func reflectOffsLock() {
@@ -181,20 +203,182 @@ func reflectOffsUnlock() {
 	unlock(&reflectOffs.lock)
 }
 
+// canonicalizeReflectType 返回 t 的规范 *_type。如果此前已有一次
+// canonicalizeReflectType 调用产生过与 t 结构相同的类型（typesEqual 判
+// 定为真），就返回那个已存在的指针——于是两次用相同字段调用
+// reflect.StructOf 会归并到同一个 *_type，而不是各自持有一份等价的副
+// 本。否则 t 自己成为它那个哈希桶的规范指针。
+//
+// 规范指针还会被登记进 reflectOffs.m/minv（复用已有登记，而不是重复分
+// 配偏移量），这样 resolveTypeOff 对这个类型返回的就是同一个 *_type，
+// 无论最初是哪个调用方构造了它。
+//
+// typesEqual 本身会走到 t.string()/t.nameOff() 这类调用 resolveNameOff
+// 的路径，而 resolveNameOff 在 findModuleForTypePtr 找不到模块时会再去
+// 获取 reflectOffsLock——这是同一把、不可重入的 mutex。所以这里绝不能
+// 在持有 reflectOffsLock 的情况下调用 typesEqual：先在锁内拍一份桶的快
+// 照，解锁后无锁地跑 typesEqual 选出规范指针，再重新加锁提交；如果这段
+// 无锁比较期间桶被别的 goroutine 并发追加过（比如两个 goroutine 同时
+// 用 reflect 构造同一个哈希的类型），就重新走一遍，避免把一个本该归并的类型误
+// 判成新的规范指针。
+func canonicalizeReflectType(t *_type) *_type {
+	for {
+		reflectOffsLock()
+		if reflectOffs.byHash == nil {
+			reflectOffs.byHash = make(map[uint32][]*_type)
+		}
+		bucket := reflectOffs.byHash[t.hash]
+		snapshot := append([]*_type(nil), bucket...)
+		reflectOffsUnlock()
+
+		canon := t
+		for _, cand := range snapshot {
+			seen := map[_typePair]struct{}{}
+			if typesEqual(t, cand, seen) {
+				canon = cand
+				break
+			}
+		}
+
+		reflectOffsLock()
+		bucket = reflectOffs.byHash[t.hash]
+		if len(bucket) != len(snapshot) {
+			// 有新的候选在我们无锁比较的这段时间里加入了这个桶；重新
+			// 拍快照并比较，防止漏判出一个本可以归并的已有类型。
+			reflectOffsUnlock()
+			continue
+		}
+		if canon == t {
+			reflectOffs.byHash[t.hash] = append(bucket, t)
+		}
+
+		if reflectOffs.m == nil {
+			reflectOffs.m = make(map[int32]unsafe.Pointer)
+			reflectOffs.minv = make(map[unsafe.Pointer]int32)
+		}
+		p := unsafe.Pointer(canon)
+		if _, ok := reflectOffs.minv[p]; !ok {
+			reflectOffs.next--
+			off := reflectOffs.next
+			reflectOffs.m[off] = p
+			reflectOffs.minv[p] = off
+		}
+
+		reflectOffsUnlock()
+		return canon
+	}
+}
+
+// reflect_canonicalType 通过 linkname 暴露给 reflect 包，使得
+// reflect.StructOf、MapOf、SliceOf、PtrTo、ArrayOf、ChanOf 和 FuncOf 能
+// 够在向 addReflectOff 登记结果之前，先经过 canonicalizeReflectType 归
+// 并。
+//
+//go:linkname reflect_canonicalType reflect.canonicalType
+func reflect_canonicalType(t *_type) *_type {
+	return canonicalizeReflectType(t)
+}
+
+// moduleRange 记录一个活跃模块的 [lo, hi) 类型区间，即
+// [md.types, md.etypes)。
+type moduleRange struct {
+	lo, hi uintptr
+	md     *moduledata
+}
+
+// moduleRangeIndex 是按 lo 排序的 moduleRange 切片，随 activeModules()
+// 一同维护，使 findModuleForTypePtr 能用二分查找定位某个指针所属的模块，
+// 而不必在每次 resolveNameOff/resolveTypeOff/textOff 调用时遍历
+// moduledata 链表。这对 dlopen 了大量插件的程序尤其重要，否则每次解析
+// 都是一次 O(N) 扫描。
+//
+// ranges 通过 atomic.Loadp/StorepNoWB 发布，和 activeModules() 对
+// modulesSlice 的做法一样：findModuleForTypePtr 在这几条运行时最热的路
+// 径上无锁读取，lock 只用来串行化 rebuildModuleRangeIndex 自身的读取-
+// 排序-发布过程，避免多个插件并发加载时互相踩到对方正在构建的切片。
+var moduleRangeIndex struct {
+	lock   mutex
+	ranges unsafe.Pointer // *[]moduleRange，只能通过 atomic 读写
+}
+
+// loadModuleRanges 无锁地读取当前发布的 moduleRangeIndex.ranges。
+func loadModuleRanges() []moduleRange {
+	p := atomic.Loadp(unsafe.Pointer(&moduleRangeIndex.ranges))
+	if p == nil {
+		return nil
+	}
+	return *(*[]moduleRange)(p)
+}
+
+// rebuildModuleRangeIndex 根据当前的 activeModules() 重新计算
+// moduleRangeIndex.ranges。活跃模块集合发生变化后都必须调用它，也就是
+// typelinksinit 和 pluginModuleInit 的末尾。
+func rebuildModuleRangeIndex() {
+	lock(&moduleRangeIndex.lock)
+	mods := activeModules()
+	ranges := make([]moduleRange, len(mods))
+	for i, md := range mods {
+		ranges[i] = moduleRange{lo: md.types, hi: md.etypes, md: md}
+	}
+	// Insertion sort by lo: the number of active modules is small enough
+	// that this beats pulling in a general-purpose sort.
+	for i := 1; i < len(ranges); i++ {
+		for j := i; j > 0 && ranges[j-1].lo > ranges[j].lo; j-- {
+			ranges[j-1], ranges[j] = ranges[j], ranges[j-1]
+		}
+	}
+
+	atomic.StorepNoWB(unsafe.Pointer(&moduleRangeIndex.ranges), unsafe.Pointer(&ranges))
+	unlock(&moduleRangeIndex.lock)
+}
+
+// findModuleForTypePtr 返回 [types, etypes) 区间包含 base 的
+// moduledata。索引没有命中时，退化为遍历 firstmoduledata 链表：这保证了
+// 在索引还没有覆盖某个模块时（比如 typelinksinit 尚未跑完之前的早期调
+// 用，或者 pluginModuleInit/typelinksinit 正在对新模块去重、但还没来得
+// 及调用 rebuildModuleRangeIndex 的那一小段时间）
+// resolveNameOff/resolveTypeOff/textOff 依然有一条始终有效的路径，和引
+// 入这个索引之前完全一样。两条路径都找不到时，调用方应转而查询
+// reflectOffs。
+func findModuleForTypePtr(base uintptr) *moduledata {
+	ranges := loadModuleRanges()
+
+	// Binary search for the last range with lo <= base.
+	lo, hi := 0, len(ranges)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if ranges[mid].lo <= base {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo > 0 {
+		if r := ranges[lo-1]; base >= r.lo && base < r.hi {
+			return r.md
+		}
+	}
+
+	for md := &firstmoduledata; md != nil; md = md.next {
+		if base >= md.types && base < md.etypes {
+			return md
+		}
+	}
+	return nil
+}
+
 func resolveNameOff(ptrInModule unsafe.Pointer, off nameOff) name {
 	if off == 0 {
 		return name{}
 	}
 	base := uintptr(ptrInModule)
-	for md := &firstmoduledata; md != nil; md = md.next {
-		if base >= md.types && base < md.etypes {
-			res := md.types + uintptr(off)
-			if res > md.etypes {
-				println("runtime: nameOff", hex(off), "out of range", hex(md.types), "-", hex(md.etypes))
-				throw("runtime: name offset out of range")
-			}
-			return name{(*byte)(unsafe.Pointer(res))}
+	if md := findModuleForTypePtr(base); md != nil {
+		res := md.types + uintptr(off)
+		if res > md.etypes {
+			println("runtime: nameOff", hex(off), "out of range", hex(md.types), "-", hex(md.etypes))
+			throw("runtime: name offset out of range")
 		}
+		return name{(*byte)(unsafe.Pointer(res))}
 	}
 
 	// No module found. see if it is a run time name.
@@ -220,13 +404,7 @@ func resolveTypeOff(ptrInModule unsafe.Pointer, off typeOff) *_type {
 		return nil
 	}
 	base := uintptr(ptrInModule)
-	var md *moduledata
-	for next := &firstmoduledata; next != nil; next = next.next {
-		if base >= next.types && base < next.etypes {
-			md = next
-			break
-		}
-	}
+	md := findModuleForTypePtr(base)
 	if md == nil {
 		reflectOffsLock()
 		res := reflectOffs.m[int32(off)]
@@ -257,13 +435,7 @@ func (t *_type) typeOff(off typeOff) *_type {
 
 func (t *_type) textOff(off textOff) unsafe.Pointer {
 	base := uintptr(unsafe.Pointer(t))
-	var md *moduledata
-	for next := &firstmoduledata; next != nil; next = next.next {
-		if base >= next.types && base < next.etypes {
-			md = next
-			break
-		}
-	}
+	md := findModuleForTypePtr(base)
 	if md == nil {
 		reflectOffsLock()
 		res := reflectOffs.m[int32(off)]
@@ -508,57 +680,97 @@ func (n name) pkgPath() string {
 	return pkgPathName.name()
 }
 
-// typelinksinit 扫描额外模块的类型并将 moduledata typemap 用于消除类型指针的重新定义。
-func typelinksinit() {
-	if firstmoduledata.next == nil {
+// typehash 是一个持久化的全局记录，记录了 typelinksinit/pluginModuleInit
+// 已经归并过的每个 *_type，以 t.hash 为键。相较于 typelinksinit 过去每次
+// 调用都重新从头构建的局部 typehash，持久化它使得之后（buildmode=plugin）
+// 动态加载的插件可以与启动时及此前加载的全部插件去重，而不只是与启动时
+// 已知的模块去重。
+var typehash struct {
+	lock mutex
+	m    map[uint32][]*_type
+}
+
+// buildModuleTypemapLocked 为 md 构建 typemap：将 md 的每个 typelinks
+// 条目与 typehash 中已累积的类型比较，typesEqual 成功时复用已有的 *_type
+// 指针。如果 md 已经有 typemap（已经处理过）则直接返回。
+//
+// 调用方必须持有 typehash.lock。
+func buildModuleTypemapLocked(md *moduledata) {
+	if md.typemap != nil {
 		return
 	}
-	typehash := make(map[uint32][]*_type, len(firstmoduledata.typelinks))
-
-	modules := activeModules()
-	prev := modules[0]
-	for _, md := range modules[1:] {
-		// 从先前的模块将类型搜集进 typehash
-	collect:
-		for _, tl := range prev.typelinks {
-			var t *_type
-			if prev.typemap == nil {
-				t = (*_type)(unsafe.Pointer(prev.types + uintptr(tl)))
-			} else {
-				t = prev.typemap[typeOff(tl)]
-			}
-			// 如果 typehash 尚未出现则将其加入
-			tlist := typehash[t.hash]
-			for _, tcur := range tlist {
-				if tcur == t {
-					continue collect
-				}
+	tm := make(map[typeOff]*_type, len(md.typelinks))
+	pinnedTypemaps = append(pinnedTypemaps, tm)
+	md.typemap = tm
+	for _, tl := range md.typelinks {
+		t := (*_type)(unsafe.Pointer(md.types + uintptr(tl)))
+		for _, candidate := range typehash.m[t.hash] {
+			seen := map[_typePair]struct{}{}
+			if typesEqual(t, candidate, seen) {
+				t = candidate
+				break
 			}
-			typehash[t.hash] = append(tlist, t)
 		}
+		md.typemap[typeOff(tl)] = t
+	}
+}
 
+// addTypesLocked 将 md 自身的类型（经过 md.typemap 归并后的最终指针）
+// 收录进全局 typehash，以便之后加载的模块能与它们去重。
+//
+// 调用方必须持有 typehash.lock。
+func addTypesLocked(md *moduledata) {
+collect:
+	for _, tl := range md.typelinks {
+		var t *_type
 		if md.typemap == nil {
-			// If any of this module's typelinks match a type from a
-			// prior module, prefer that prior type by adding the offset
-			// to this module's typemap.
-			tm := make(map[typeOff]*_type, len(md.typelinks))
-			pinnedTypemaps = append(pinnedTypemaps, tm)
-			md.typemap = tm
-			for _, tl := range md.typelinks {
-				t := (*_type)(unsafe.Pointer(md.types + uintptr(tl)))
-				for _, candidate := range typehash[t.hash] {
-					seen := map[_typePair]struct{}{}
-					if typesEqual(t, candidate, seen) {
-						t = candidate
-						break
-					}
-				}
-				md.typemap[typeOff(tl)] = t
+			t = (*_type)(unsafe.Pointer(md.types + uintptr(tl)))
+		} else {
+			t = md.typemap[typeOff(tl)]
+		}
+		tlist := typehash.m[t.hash]
+		for _, tcur := range tlist {
+			if tcur == t {
+				continue collect
 			}
 		}
+		typehash.m[t.hash] = append(tlist, t)
+	}
+}
 
-		prev = md
+// typelinksinit 扫描所有已知模块（主程序，以及 buildmode=shared 下链接器
+// 在启动时就合并好的模块）的类型，为它们填充 typemap 以消除类型指针的
+// 重复定义，并将这些类型收录进全局 typehash，供之后 dlopen 的插件
+// （见 pluginModuleInit）去重。
+func typelinksinit() {
+	lock(&typehash.lock)
+	typehash.m = make(map[uint32][]*_type, len(firstmoduledata.typelinks))
+	addTypesLocked(&firstmoduledata)
+	for _, md := range activeModules()[1:] {
+		buildModuleTypemapLocked(md)
+		addTypesLocked(md)
 	}
+	unlock(&typehash.lock)
+	rebuildModuleRangeIndex()
+}
+
+// pluginModuleInit 注册 md —— 一个在程序启动后通过 buildmode=plugin
+// dlopen 加载的模块的 moduledata —— 将它的类型与迄今为止见过的所有模块
+// （启动时已有的模块，以及此前加载的插件）去重，并将它自身的类型并入
+// 全局 typehash，以便更晚加载的插件可以反过来与它去重。
+//
+// 调用方需确保 md 在调用前已经被加到 activeModules() 中，即在 dlopen
+// 完成并把新模块接入模块链表之后才调用本函数。这里用 typehash.lock 保护
+// 并发的插件加载。
+func pluginModuleInit(md *moduledata) {
+	lock(&typehash.lock)
+	if typehash.m == nil {
+		typehash.m = make(map[uint32][]*_type, len(md.typelinks))
+	}
+	buildModuleTypemapLocked(md)
+	addTypesLocked(md)
+	unlock(&typehash.lock)
+	rebuildModuleRangeIndex()
 }
 
 type _typePair struct {
@@ -710,4 +922,59 @@ func typesEqual(t, v *_type, seen map[_typePair]struct{}) bool {
 		throw("runtime: impossible type kind")
 		return false
 	}
-}
\ No newline at end of file
+}
+
+// forEachType 对运行时当前已知的每一个 *_type 调用一次 fn：先遍历每个活
+// 跃模块的 typelinks（经由该模块的 typemap 归并，使 buildmode=shared 下
+// 的别名收敛到同一个指针），再遍历 reflect 通过 canonicalizeReflectType
+// 归并过的每个类型。fn 返回 false 可以提前终止遍历。
+//
+// forEachType 仅在给 reflect 类型拍快照时持有 reflectOffsLock；调用 fn
+// 时不持有任何锁，并通过一个按指针去重的内部集合跳过重复项（两个来源
+// 之间，或模块别名之间）。
+func forEachType(fn func(*_type) bool) {
+	seen := make(map[*_type]struct{})
+
+	for _, md := range activeModules() {
+		for _, tl := range md.typelinks {
+			var t *_type
+			if md.typemap == nil {
+				t = (*_type)(unsafe.Pointer(md.types + uintptr(tl)))
+			} else {
+				t = md.typemap[typeOff(tl)]
+			}
+			if _, dup := seen[t]; dup {
+				continue
+			}
+			seen[t] = struct{}{}
+			if !fn(t) {
+				return
+			}
+		}
+	}
+
+	reflectOffsLock()
+	var reflectTypes []*_type
+	for _, bucket := range reflectOffs.byHash {
+		reflectTypes = append(reflectTypes, bucket...)
+	}
+	reflectOffsUnlock()
+
+	for _, t := range reflectTypes {
+		if _, dup := seen[t]; dup {
+			continue
+		}
+		seen[t] = struct{}{}
+		if !fn(t) {
+			return
+		}
+	}
+}
+
+// runtime_reflect_forEachType 通过 linkname 暴露给 reflect 包，由它包装
+// 为 reflect.RangeTypes(func(reflect.Type) bool)。
+//
+//go:linkname runtime_reflect_forEachType reflect.runtime_forEachType
+func runtime_reflect_forEachType(fn func(*_type) bool) {
+	forEachType(fn)
+}
@@ -0,0 +1,238 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+import (
+	"runtime/internal/atomic"
+	"testing"
+	"unsafe"
+)
+
+// encodeName 按照 runtime.name 的编码方式构造一段只包含名字（没有导出位、
+// 没有 tag）的字节序列，供测试构造 *_type 值使用。
+func encodeName(s string) []byte {
+	buf := make([]byte, 3+len(s))
+	buf[1] = byte(len(s) >> 8)
+	buf[2] = byte(len(s))
+	copy(buf[3:], s)
+	return buf
+}
+
+// registerName 把 s 的编码名字通过 reflectOffs 固定住并返回其 nameOff，
+// 这样构造出来的 *_type 的 str 字段可以像真实的编译期类型一样通过
+// resolveNameOff 解析，而不必搭建一个真实的 moduledata 类型区间。
+func registerName(tb testing.TB, s string) nameOff {
+	tb.Helper()
+	if len(s) > 1<<16-1 {
+		tb.Fatal("name too long for test")
+	}
+	buf := encodeName(s)
+
+	reflectOffsLock()
+	if reflectOffs.m == nil {
+		reflectOffs.m = make(map[int32]unsafe.Pointer)
+		reflectOffs.minv = make(map[unsafe.Pointer]int32)
+	}
+	reflectOffs.next--
+	off := reflectOffs.next
+	reflectOffs.m[off] = unsafe.Pointer(&buf[0])
+	reflectOffs.minv[unsafe.Pointer(&buf[0])] = off
+	reflectOffsUnlock()
+
+	return nameOff(off)
+}
+
+func TestTypeNameGenerics(t *testing.T) {
+	cases := []struct {
+		full, want string
+	}{
+		{"main.List[int]", "List[int]"},
+		{"main.Map[main.K, main.V]", "Map[main.K, main.V]"},
+		{"main.Pair[main.List[int], int]", "Pair[main.List[int], int]"},
+	}
+	for _, c := range cases {
+		typ := &_type{tflag: tflagNamed, str: registerName(t, c.full)}
+		if got := typ.name(); got != c.want {
+			t.Errorf("name() for %q = %q, want %q", c.full, got, c.want)
+		}
+	}
+}
+
+// TestPluginModuleDedup 模拟两个 typelinks 重叠的 moduledata ——例如一个
+// 插件和宿主程序各自内嵌了同一个包——并验证 addTypesLocked/
+// buildModuleTypemapLocked（typelinksinit 和 pluginModuleInit 共用的去重
+// 核心逻辑）之后，后加载模块的类型会被归并回先加载模块的指针，而不是
+// 各自持有一份等价的副本。
+func TestPluginModuleDedup(t *testing.T) {
+	str := registerName(t, "main.Widget")
+
+	// t1、t2 代表两个 moduledata 里各自的同一个类型：kind、hash、字符串
+	// 表示都相同，但指针不同，就像同一个包被编译进两个不同模块时那样。
+	t1 := &_type{kind: kindBool, hash: 777, str: str}
+	t2 := &_type{kind: kindBool, hash: 777, str: str}
+
+	md1 := &moduledata{
+		typelinks: []int32{0},
+		types:     uintptr(unsafe.Pointer(t1)),
+		etypes:    uintptr(unsafe.Pointer(t1)) + unsafe.Sizeof(_type{}),
+	}
+	md2 := &moduledata{
+		typelinks: []int32{0},
+		types:     uintptr(unsafe.Pointer(t2)),
+		etypes:    uintptr(unsafe.Pointer(t2)) + unsafe.Sizeof(_type{}),
+	}
+
+	lock(&typehash.lock)
+	saved := typehash.m
+	typehash.m = make(map[uint32][]*_type)
+	addTypesLocked(md1)
+	buildModuleTypemapLocked(md2)
+	typehash.m = saved
+	unlock(&typehash.lock)
+
+	got := md2.typemap[typeOff(0)]
+	if got != t1 {
+		t.Fatalf("md2's type deduped to %p, want %p (md1's type)", got, t1)
+	}
+}
+
+// withModuleRanges 临时用 ranges 替换 moduleRangeIndex 发布的切片，返回
+// 一个测试结束时恢复原值的函数。和 rebuildModuleRangeIndex 一样，通过
+// atomic.StorepNoWB 发布，这样 findModuleForTypePtr 的无锁读取看到的是
+// 一次性生效的整个切片，不会读到半更新的状态。
+func withModuleRanges(tb testing.TB, ranges []moduleRange) func() {
+	tb.Helper()
+	lock(&moduleRangeIndex.lock)
+	saved := loadModuleRanges()
+	atomic.StorepNoWB(unsafe.Pointer(&moduleRangeIndex.ranges), unsafe.Pointer(&ranges))
+	unlock(&moduleRangeIndex.lock)
+	return func() {
+		lock(&moduleRangeIndex.lock)
+		atomic.StorepNoWB(unsafe.Pointer(&moduleRangeIndex.ranges), unsafe.Pointer(&saved))
+		unlock(&moduleRangeIndex.lock)
+	}
+}
+
+// syntheticModules 构造 n 个互不重叠、按 lo 排序的 moduledata，每个占据
+// [i*100+1, i*100+50) 这段类型区间，供 findModuleForTypePtr 的测试和基准
+// 使用。
+func syntheticModules(n int) ([]moduledata, []moduleRange) {
+	mds := make([]moduledata, n)
+	ranges := make([]moduleRange, n)
+	for i := range mds {
+		mds[i].types = uintptr(i*100 + 1)
+		mds[i].etypes = uintptr(i*100 + 50)
+		ranges[i] = moduleRange{lo: mds[i].types, hi: mds[i].etypes, md: &mds[i]}
+	}
+	return mds, ranges
+}
+
+func TestFindModuleForTypePtr(t *testing.T) {
+	mds, ranges := syntheticModules(8)
+	defer withModuleRanges(t, ranges)()
+
+	for i := range mds {
+		if got := findModuleForTypePtr(mds[i].types); got != &mds[i] {
+			t.Errorf("findModuleForTypePtr(%d) = %p, want %p", i, got, &mds[i])
+		}
+	}
+
+	// A gap between ranges belongs to no module; the firstmoduledata
+	// fallback won't find a synthetic module either, so this must be nil.
+	if got := findModuleForTypePtr(mds[0].etypes + 1); got != nil {
+		t.Errorf("findModuleForTypePtr(gap) = %p, want nil", got)
+	}
+}
+
+func benchmarkFindModuleForTypePtr(b *testing.B, n int) {
+	mds, ranges := syntheticModules(n)
+	defer withModuleRanges(b, ranges)()
+
+	target := mds[n-1].types
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		findModuleForTypePtr(target)
+	}
+}
+
+func BenchmarkFindModuleForTypePtr1(b *testing.B)  { benchmarkFindModuleForTypePtr(b, 1) }
+func BenchmarkFindModuleForTypePtr8(b *testing.B)  { benchmarkFindModuleForTypePtr(b, 8) }
+func BenchmarkFindModuleForTypePtr64(b *testing.B) { benchmarkFindModuleForTypePtr(b, 64) }
+
+// newTestStructType 构造一个表示 "struct { X bool }" 的 *structtype，供
+// TestCanonicalizeReflectType 模拟 reflect.StructOf 两次构造同一个结构体
+// 类型的场景使用。
+func newTestStructType(t *testing.T, strOff nameOff, elem *_type) *structtype {
+	fieldName := encodeName("X")
+	pkgPath := encodeName("")
+	return &structtype{
+		typ:     _type{kind: kindStruct, hash: 31337, str: strOff},
+		pkgPath: name{bytes: &pkgPath[0]},
+		fields: []structfield{{
+			name: name{bytes: &fieldName[0]},
+			typ:  elem,
+		}},
+	}
+}
+
+func TestCanonicalizeReflectType(t *testing.T) {
+	strOff := registerName(t, "struct { X bool }")
+	elem := &_type{kind: kindBool}
+
+	a := newTestStructType(t, strOff, elem)
+	b := newTestStructType(t, strOff, elem)
+
+	ca := canonicalizeReflectType(&a.typ)
+	if ca != &a.typ {
+		t.Fatalf("canonicalizeReflectType(a) = %p, want %p (itself, first registration)", ca, &a.typ)
+	}
+
+	cb := canonicalizeReflectType(&b.typ)
+	if cb != &a.typ {
+		t.Fatalf("canonicalizeReflectType(b) = %p, want %p (a, the first-registered identical type)", cb, &a.typ)
+	}
+
+	// The canonical pointer must also be resolvable through resolveTypeOff,
+	// via the reflectOffs.m/minv entry canonicalizeReflectType registers.
+	reflectOffsLock()
+	off, ok := reflectOffs.minv[unsafe.Pointer(ca)]
+	reflectOffsUnlock()
+	if !ok {
+		t.Fatal("canonical type was not registered in reflectOffs.minv")
+	}
+	if got := resolveTypeOff(unsafe.Pointer(ca), typeOff(off)); got != ca {
+		t.Fatalf("resolveTypeOff(canonical off) = %p, want %p", got, ca)
+	}
+}
+
+// TestForEachType 验证一个通过 canonicalizeReflectType 归并过的反射类型
+// ——模拟 reflect.StructOf 的产物——恰好被访问一次，forEachType 访问到
+// 的每个类型（包括经由真实 activeModules() 得到的类型）都只出现一次，
+// 且访问到的类型不为空。它不检查某个具体的内建类型是否被访问到。
+func TestForEachType(t *testing.T) {
+	str := registerName(t, "main.ForEachTypeProbe")
+	probe := &_type{kind: kindBool, tflag: tflagNamed, str: str, hash: 271828}
+	if got := canonicalizeReflectType(probe); got != probe {
+		t.Fatalf("canonicalizeReflectType(probe) = %p, want %p", got, probe)
+	}
+
+	visited := make(map[*_type]int)
+	forEachType(func(typ *_type) bool {
+		visited[typ]++
+		return true
+	})
+
+	if visited[probe] != 1 {
+		t.Errorf("probe type visited %d times, want exactly 1", visited[probe])
+	}
+	for typ, n := range visited {
+		if n != 1 {
+			t.Errorf("type %p visited %d times, want exactly 1", typ, n)
+		}
+	}
+	if len(visited) == 0 {
+		t.Error("forEachType visited no types at all")
+	}
+}